@@ -8,7 +8,6 @@ import (
 	"net/netip"
 
 	"github.com/bepass-org/warp-plus/psiphon"
-	"github.com/bepass-org/warp-plus/warp"
 	"github.com/bepass-org/warp-plus/wiresocks"
 )
 
@@ -22,8 +21,33 @@ type WarpOptions struct {
 	License  string
 	Psiphon  *PsiphonOptions
 	Gool     bool
-	Scan     *wiresocks.ScanOptions
-	Tun      *TunOptions
+	// Hops stacks this many WARP layers instead of the single/gool
+	// modes; Hops == 1 is the old single mode and Hops == 2 is gool.
+	// Gool is kept as a convenience for Hops == 2 and is ignored when
+	// Hops is set explicitly.
+	Hops int
+	Scan *wiresocks.ScanOptions
+	Tun  *TunOptions
+
+	// WireGuardInbound, when set, runs warp-plus as a WireGuard server
+	// instead of a SOCKS proxy or TUN: clients connect directly with a
+	// WireGuard client and their egress traffic is carried by the WARP
+	// tunnel built from Endpoint.
+	WireGuardInbound *WireGuardInboundOptions
+
+	// WorkDir is the directory identities are stored under when Identities
+	// is nil. Defaults to "./stuff" for backwards compatibility.
+	WorkDir string
+	// Identities overrides where WARP identities are loaded from and
+	// saved to, letting embedders (mobile apps, tests, plugins) supply an
+	// in-memory store instead of writing to disk. Defaults to a
+	// FileIdentityStore rooted at WorkDir.
+	Identities IdentityStore
+
+	// DNS, when set, installs a resolver inside the userspace netstack so
+	// SOCKS/TUN clients' DNS queries are answered locally instead of
+	// leaking around the tunnel.
+	DNS *DNSOptions
 }
 
 type PsiphonOptions struct {
@@ -47,60 +71,118 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 		return errors.New("can't use psiphon and tun at the same time")
 	}
 
+	if opts.WireGuardInbound != nil && (opts.Psiphon != nil || opts.Gool || opts.Tun != nil) {
+		return errors.New("can't combine wireguard inbound mode with psiphon, gool or tun")
+	}
+
+	if opts.DNS != nil && opts.Tun != nil {
+		return errors.New("can't use the built-in dns resolver with tun: it only installs on the userspace netstack, which tun mode doesn't use")
+	}
+
+	if opts.DNS != nil && opts.WireGuardInbound != nil {
+		return errors.New("can't use the built-in dns resolver with wireguard inbound mode: it has no SOCKS/TUN netstack to install the resolver on")
+	}
+
+	if opts.WireGuardInbound != nil {
+		if err := validateWireGuardInboundOptions(opts.WireGuardInbound); err != nil {
+			return err
+		}
+	}
+
+	hops := opts.Hops
+	if hops == 0 {
+		if opts.Gool {
+			hops = 2
+		} else {
+			hops = 1
+		}
+	}
+
+	store := opts.Identities
+	if store == nil {
+		workDir := opts.WorkDir
+		if workDir == "" {
+			workDir = "./stuff"
+		}
+		store = NewFileIdentityStore(workDir)
+	}
+
 	// create identities
-	if err := createPrimaryAndSecondaryIdentities(l.With("subsystem", "warp/account"), opts.License); err != nil {
+	primary, secondary, err := createPrimaryAndSecondaryIdentities(l.With("subsystem", "warp/account"), store, opts.License)
+	if err != nil {
 		return err
 	}
 
 	// Decide Working Scenario
-	endpoints := []string{opts.Endpoint, opts.Endpoint}
+	endpoints := make([]string, hops)
+	for i := range endpoints {
+		endpoints[i] = opts.Endpoint
+	}
 
 	if opts.Scan != nil {
 		res, err := wiresocks.RunScan(ctx, l, *opts.Scan)
 		if err != nil {
 			return err
 		}
+		if len(res) == 0 {
+			return errors.New("scan found no reachable warp endpoints")
+		}
 
 		l.Info("scan results", "endpoints", res)
 
-		endpoints = make([]string, len(res))
-		for i := 0; i < len(res); i++ {
-			endpoints[i] = res[i].AddrPort.String()
+		endpoints = make([]string, hops)
+		for i := range endpoints {
+			endpoints[i] = res[i%len(res)].AddrPort.String()
 		}
 	}
 	l.Info("using warp endpoints", "endpoints", endpoints)
 
-	var warpErr error
+	// RunWarp is a small orchestrator: pick the subsystem this call needs
+	// and let runServices own its PreStart/Start/Close lifecycle so a
+	// failure partway through never leaks whatever already came up.
+	var tunnel Service
 	switch {
+	case opts.WireGuardInbound != nil:
+		l.Info("running in wireguard inbound mode")
+		tunnel = &funcService{
+			name:  "wireguard inbound",
+			start: func(ctx context.Context) error { return runWarpAsWireGuardServer(ctx, l, endpoints[0], opts.WireGuardInbound, primary) },
+		}
 	case opts.Psiphon != nil:
 		l.Info("running in Psiphon (cfon) mode")
-		// run primary warp on a random tcp port and run psiphon on bind address
-		warpErr = runWarpWithPsiphon(ctx, l, opts.Bind, endpoints[0], opts.Psiphon.Country)
-	case opts.Gool:
-		l.Info("running in warp-in-warp (gool) mode")
-		// run warp in warp
-		warpErr = runWarpInWarp(ctx, l, opts.Bind, endpoints, opts.Tun)
+		tunnel = &funcService{
+			name:  "psiphon",
+			start: func(ctx context.Context) error { return runWarpWithPsiphon(ctx, l, opts.Bind, endpoints[0], opts.Psiphon.Country, primary) },
+		}
+	case hops >= 2:
+		l.Info("running warp chain", "hops", hops)
+		hopConfigs, err := buildHopConfigs(l, store, opts.License, endpoints, primary, secondary)
+		if err != nil {
+			return err
+		}
+		// runWarpChain manages its own per-hop services internally
+		tunnel = &funcService{
+			name:  "warp chain",
+			start: func(ctx context.Context) error { return runWarpChain(ctx, l, opts.Bind, hopConfigs, opts.Tun, opts.DNS) },
+		}
 	default:
 		l.Info("running in normal warp mode")
-		// just run primary warp on bindAddress
-		warpErr = runWarp(ctx, l, opts.Bind, endpoints[0], opts.Tun)
+		tunnel = &funcService{
+			name:  "warp",
+			start: func(ctx context.Context) error { return runWarp(ctx, l, opts.Bind, endpoints[0], opts.Tun, primary, opts.DNS) },
+		}
 	}
 
-	return warpErr
+	return runServices(ctx, []Service{tunnel})
 }
 
-func runWarp(ctx context.Context, l *slog.Logger, bind netip.AddrPort, endpoint string, tun *TunOptions) error {
-	// Set up primary/outer warp config
-	conf, err := wiresocks.ParseConfig("./stuff/primary/wgcf-profile.ini", endpoint)
-	if err != nil {
-		return err
-	}
-
+func runWarp(ctx context.Context, l *slog.Logger, bind netip.AddrPort, endpoint string, tun *TunOptions, conf *wiresocks.Config, dns *DNSOptions) error {
 	// Set up MTU
 	conf.Interface.MTU = singleMTU
 
 	// Enable trick and keepalive on all peers in config
 	for i, peer := range conf.Peers {
+		peer.Endpoint = endpoint
 		peer.Trick = true
 		peer.KeepAlive = 3
 		conf.Peers[i] = peer
@@ -126,6 +208,7 @@ func runWarp(ctx context.Context, l *slog.Logger, bind netip.AddrPort, endpoint
 	if err != nil {
 		return err
 	}
+	logTunOffload(l, tunDev)
 
 	// Establish wireguard on userspace stack
 	if err := establishWireguard(l, conf, tunDev, 0); err != nil {
@@ -134,106 +217,22 @@ func runWarp(ctx context.Context, l *slog.Logger, bind netip.AddrPort, endpoint
 
 	// Test wireguard connectivity
 	if err := usermodeTunTest(ctx, l, tnet); err != nil {
+		tunDev.Close()
 		return err
 	}
 
-	// Run a proxy on the userspace stack
-	_, err = wiresocks.StartProxy(ctx, l, tnet, bind)
-	if err != nil {
-		return err
-	}
-
-	l.Info("serving proxy", "address", bind)
-	return nil
-}
-
-func runWarpInWarp(ctx context.Context, l *slog.Logger, bind netip.AddrPort, endpoints []string, tun *TunOptions) error {
-	// Set up primary/outer warp config
-	conf, err := wiresocks.ParseConfig("./stuff/primary/wgcf-profile.ini", endpoints[0])
-	if err != nil {
-		return err
-	}
-
-	// Set up MTU
-	conf.Interface.MTU = singleMTU
-
-	// Enable trick and keepalive on all peers in config
-	for i, peer := range conf.Peers {
-		peer.Trick = true
-		peer.KeepAlive = 3
-		conf.Peers[i] = peer
-	}
-
-	// Create userspace tun network stack
-	tunDev, tnet, err := newUsermodeTun(conf)
-	if err != nil {
-		return err
-	}
-
-	// Establish wireguard on userspace stack
-	if err := establishWireguard(l.With("gool", "outer"), conf, tunDev, 0); err != nil {
-		return err
-	}
-
-	// Test wireguard connectivity
-	if err := usermodeTunTest(ctx, l, tnet); err != nil {
-		return err
-	}
-
-	// Create a UDP port forward between localhost and the remote endpoint
-	addr, err := wiresocks.NewVtunUDPForwarder(ctx, netip.MustParseAddrPort("127.0.0.1:0"), endpoints[0], tnet, singleMTU)
-	if err != nil {
-		return err
-	}
-
-	// Set up secondary/inner warp config
-	conf, err = wiresocks.ParseConfig("./stuff/secondary/wgcf-profile.ini", addr.String())
-	if err != nil {
-		return err
-	}
-
-	// Set up MTU
-	conf.Interface.MTU = doubleMTU
-
-	// Enable keepalive on all peers in config
-	for i, peer := range conf.Peers {
-		peer.KeepAlive = 10
-		conf.Peers[i] = peer
-	}
-
-	if tun != nil {
-		// Create a new tun interface
-		tunDev, err := newNormalTun()
-		if err != nil {
-			return err
-		}
-
-		// Establish wireguard tunnel on tun interface
-		if err := establishWireguard(l.With("gool", "inner"), conf, tunDev, tun.FwMark); err != nil {
-			return err
-		}
-		l.Info("serving tun", "interface", "warp0")
-		return nil
-	}
-
-	// Create userspace tun network stack
-	tunDev, tnet, err = newUsermodeTun(conf)
-	if err != nil {
-		return err
-	}
-
-	// Establish wireguard on userspace stack
-	if err := establishWireguard(l.With("gool", "inner"), conf, tunDev, 0); err != nil {
-		return err
-	}
-
-	// Test wireguard connectivity
-	if err := usermodeTunTest(ctx, l, tnet); err != nil {
-		return err
+	if dns != nil {
+		go func() {
+			if err := runDNSResolver(ctx, l.With("subsystem", "dns"), tnet, dns); err != nil {
+				l.Error("dns resolver stopped", "error", err)
+			}
+		}()
 	}
 
+	// Run a proxy on the userspace stack
 	_, err = wiresocks.StartProxy(ctx, l, tnet, bind)
 	if err != nil {
+		tunDev.Close()
 		return err
 	}
 
@@ -241,18 +240,13 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, bind netip.AddrPort, end
 	return nil
 }
 
-func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, bind netip.AddrPort, endpoint string, country string) error {
-	// Set up primary/outer warp config
-	conf, err := wiresocks.ParseConfig("./stuff/primary/wgcf-profile.ini", endpoint)
-	if err != nil {
-		return err
-	}
-
+func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, bind netip.AddrPort, endpoint string, country string, conf *wiresocks.Config) error {
 	// Set up MTU
 	conf.Interface.MTU = singleMTU
 
 	// Enable trick and keepalive on all peers in config
 	for i, peer := range conf.Peers {
+		peer.Endpoint = endpoint
 		peer.Trick = true
 		peer.KeepAlive = 3
 		conf.Peers[i] = peer
@@ -263,6 +257,7 @@ func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, bind netip.AddrPort
 	if err != nil {
 		return err
 	}
+	logTunOffload(l, tunDev)
 
 	// Establish wireguard on userspace stack
 	if err := establishWireguard(l, conf, tunDev, 0); err != nil {
@@ -271,39 +266,24 @@ func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, bind netip.AddrPort
 
 	// Test wireguard connectivity
 	if err := usermodeTunTest(ctx, l, tnet); err != nil {
+		tunDev.Close()
 		return err
 	}
 
 	// Run a proxy on the userspace stack
 	warpBind, err := wiresocks.StartProxy(ctx, l, tnet, netip.MustParseAddrPort("127.0.0.1:0"))
 	if err != nil {
+		tunDev.Close()
 		return err
 	}
 
 	// run psiphon
 	err = psiphon.RunPsiphon(ctx, l.With("subsystem", "psiphon"), warpBind.String(), bind.String(), country)
 	if err != nil {
+		tunDev.Close()
 		return fmt.Errorf("unable to run psiphon %w", err)
 	}
 
 	l.Info("serving proxy", "address", bind)
 	return nil
 }
-
-func createPrimaryAndSecondaryIdentities(l *slog.Logger, license string) error {
-	// make primary identity
-	err := warp.LoadOrCreateIdentity(l, "./stuff/primary", license)
-	if err != nil {
-		l.Error("couldn't load primary warp identity")
-		return err
-	}
-
-	// make secondary
-	err = warp.LoadOrCreateIdentity(l, "./stuff/secondary", license)
-	if err != nil {
-		l.Error("couldn't load secondary warp identity")
-		return err
-	}
-
-	return nil
-}
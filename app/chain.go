@@ -0,0 +1,218 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+
+	"golang.zx2c4.com/wireguard/tun"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// HopConfig describes one layer of a warp chain: the endpoint it dials,
+// the MTU it negotiates at, whether it uses the trick/keepalive dance the
+// free WARP endpoints expect, and the identity its wgcf profile comes from.
+type HopConfig struct {
+	Endpoint  string
+	MTU       int
+	KeepAlive int
+	Trick     bool
+	Identity  *wiresocks.Config
+}
+
+// runWarpChain generalizes gool (warp-in-warp) to an arbitrary number of
+// stacked WARP layers. hops[0] is the outermost layer, dialed directly;
+// each subsequent hop is reached through a UDP forwarder running on the
+// previous hop's netstack. Only the final hop attaches to the OS TUN (if
+// tun is set) or exposes the SOCKS proxy on bind. Each hop is a Service, so
+// a failure partway through the chain closes every hop's tun that already
+// came up instead of leaking it; a hop's forwarder has no handle of its own
+// and is only unwound by its tun going away.
+func runWarpChain(ctx context.Context, l *slog.Logger, bind netip.AddrPort, hops []HopConfig, tun *TunOptions, dns *DNSOptions) error {
+	if len(hops) == 0 {
+		return fmt.Errorf("warp chain requires at least one hop")
+	}
+
+	resolved := make([]string, len(hops))
+	resolved[0] = hops[0].Endpoint
+
+	services := make([]Service, len(hops))
+	for i := range hops {
+		services[i] = &hopService{
+			hops:     hops,
+			index:    i,
+			bind:     bind,
+			tun:      tun,
+			dns:      dns,
+			l:        l.With("hop", i),
+			resolved: resolved,
+		}
+	}
+
+	return runServices(ctx, services)
+}
+
+// hopService establishes one HopConfig as a wireguard tunnel and, unless it
+// is the chain's last hop, forwards the next hop's traffic through it.
+type hopService struct {
+	hops  []HopConfig
+	index int
+	bind  netip.AddrPort
+	tun   *TunOptions
+	dns   *DNSOptions
+	l     *slog.Logger
+
+	// resolved holds the dial target for every hop; this hop reads
+	// resolved[index] (seeded with hops[0].Endpoint, or written by the
+	// previous hop's Start) and, unless it's the last hop, writes the
+	// local forwarder address the next hop should dial into
+	// resolved[index+1] before returning.
+	resolved []string
+
+	tunDev tun.Device
+}
+
+func (s *hopService) Name() string {
+	return fmt.Sprintf("warp chain hop %d", s.index)
+}
+
+func (s *hopService) Start(ctx context.Context) (err error) {
+	// runServices only closes hops whose Start succeeded, so a hop that
+	// fails partway closes whatever tun it already brought up itself.
+	defer func() {
+		if err != nil {
+			_ = s.Close()
+		}
+	}()
+
+	hop := s.hops[s.index]
+	last := s.index == len(s.hops)-1
+
+	conf := hop.Identity
+	conf.Interface.MTU = hop.MTU
+	for j, peer := range conf.Peers {
+		peer.Endpoint = s.resolved[s.index]
+		peer.Trick = hop.Trick
+		peer.KeepAlive = hop.KeepAlive
+		conf.Peers[j] = peer
+	}
+
+	if last && s.tun != nil {
+		tunDev, err := newNormalTun()
+		if err != nil {
+			return err
+		}
+		s.tunDev = tunDev
+		if err := establishWireguard(s.l, conf, tunDev, s.tun.FwMark); err != nil {
+			return err
+		}
+		s.l.Info("serving tun", "interface", "warp0")
+		return nil
+	}
+
+	tunDev, tnet, err := newUsermodeTun(conf)
+	if err != nil {
+		return fmt.Errorf("create netstack: %w", err)
+	}
+	s.tunDev = tunDev
+	logTunOffload(s.l, tunDev)
+
+	if err := establishWireguard(s.l, conf, tunDev, 0); err != nil {
+		return fmt.Errorf("establish wireguard: %w", err)
+	}
+	if err := usermodeTunTest(ctx, s.l, tnet); err != nil {
+		return fmt.Errorf("test connectivity: %w", err)
+	}
+
+	if last {
+		if s.dns != nil {
+			go func() {
+				if err := runDNSResolver(ctx, s.l.With("subsystem", "dns"), tnet, s.dns); err != nil {
+					s.l.Error("dns resolver stopped", "error", err)
+				}
+			}()
+		}
+		if _, err := wiresocks.StartProxy(ctx, s.l, tnet, s.bind); err != nil {
+			return err
+		}
+		s.l.Info("serving proxy", "address", s.bind)
+		return nil
+	}
+
+	next := s.hops[s.index+1]
+	addr, err := wiresocks.NewVtunUDPForwarder(ctx, netip.MustParseAddrPort("127.0.0.1:0"), next.Endpoint, tnet, hop.MTU)
+	if err != nil {
+		return fmt.Errorf("forward to next hop: %w", err)
+	}
+	s.resolved[s.index+1] = addr.String()
+
+	return nil
+}
+
+// Close tears down the tun this hop brought up, if it got that far.
+// wiresocks doesn't hand back anything to close the forwarder with, so a
+// hop that made it past NewVtunUDPForwarder relies on its tun going away to
+// unwind the forwarder along with it.
+func (s *hopService) Close() error {
+	if s.tunDev == nil {
+		return nil
+	}
+	return s.tunDev.Close()
+}
+
+// chainHopMTU returns the MTU for hop k of n, shrinking by a fixed 10-byte
+// step at each layer with a floor at the IPv6 minimum MTU. The
+// overhead is deliberately small enough to leave room to step down across
+// several hops before hitting the floor - singleMTU and doubleMTU only
+// differ by 50, so anything larger than that bottoms every hop past the
+// first out at doubleMTU and a chain never actually gets decreasing MTUs.
+func chainHopMTU(k int) int {
+	const overhead = 10 // per-hop step, smaller than a full outer UDP/IP + wireguard header
+	mtu := singleMTU - k*overhead
+	if mtu < doubleMTU {
+		return doubleMTU
+	}
+	return mtu
+}
+
+// buildHopConfigs turns a list of per-hop endpoints into HopConfigs,
+// reusing the already-loaded primary/secondary identities for the first
+// two hops (so gool users keep their existing identities) and loading or
+// creating one "hopN" identity per store for any hop beyond that.
+func buildHopConfigs(l *slog.Logger, store IdentityStore, license string, endpoints []string, primary, secondary *wiresocks.Config) ([]HopConfig, error) {
+	identities := make([]*wiresocks.Config, len(endpoints))
+	if len(endpoints) > 0 {
+		identities[0] = primary
+	}
+	if len(endpoints) > 1 {
+		identities[1] = secondary
+	}
+	for i := 2; i < len(endpoints); i++ {
+		id, err := loadOrCreateIdentity(l.With("hop", i), store, fmt.Sprintf("hop%d", i+1), license)
+		if err != nil {
+			return nil, err
+		}
+		identities[i] = id
+	}
+
+	hops := make([]HopConfig, len(endpoints))
+	for i, endpoint := range endpoints {
+		mtu := singleMTU
+		keepAlive := 3
+		trick := i == 0
+		if i > 0 {
+			mtu = chainHopMTU(i)
+			keepAlive = 10
+		}
+		hops[i] = HopConfig{
+			Endpoint:  endpoint,
+			MTU:       mtu,
+			KeepAlive: keepAlive,
+			Trick:     trick,
+			Identity:  identities[i],
+		}
+	}
+	return hops, nil
+}
@@ -0,0 +1,32 @@
+package app
+
+import "testing"
+
+func TestChainHopMTU(t *testing.T) {
+	if got := chainHopMTU(0); got != singleMTU {
+		t.Errorf("chainHopMTU(0) = %d, want singleMTU %d", got, singleMTU)
+	}
+
+	prev := singleMTU
+	sawDecrease := false
+	for k := 1; k <= 5; k++ {
+		got := chainHopMTU(k)
+		if got > prev {
+			t.Errorf("chainHopMTU(%d) = %d, want <= previous hop's %d", k, got, prev)
+		}
+		if got < prev {
+			sawDecrease = true
+		}
+		if got < doubleMTU {
+			t.Errorf("chainHopMTU(%d) = %d, below floor %d", k, got, doubleMTU)
+		}
+		prev = got
+	}
+	if !sawDecrease {
+		t.Error("chainHopMTU never decreases across hops 1-5, multi-hop chains get no MTU step-down")
+	}
+
+	if got := chainHopMTU(100); got != doubleMTU {
+		t.Errorf("chainHopMTU(100) = %d, want floor %d", got, doubleMTU)
+	}
+}
@@ -0,0 +1,269 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// DNSOptions configures the built-in resolver installed on the userspace
+// netstack. When set on WarpOptions, every DNS query from a SOCKS/TUN
+// client is intercepted and answered locally instead of leaking around the
+// tunnel, mirroring Tailscale's magic-DNS design.
+type DNSOptions struct {
+	// Upstreams are "ip:port" DNS servers dialed over UDP through the
+	// WARP tunnel. Only Upstreams[0] is ever queried: for every name when
+	// DoHURL is empty, and only for SplitSuffixes matches when DoHURL is
+	// set. Later entries are not used as fallbacks.
+	Upstreams []string
+	// DoHURL, when set, takes priority over Upstreams: queries are sent
+	// as DNS-over-HTTPS requests dialed through the WARP tunnel, e.g.
+	// "https://1.1.1.1/dns-query" so resolution is pinned to the
+	// encrypted tunnel even in censored networks.
+	DoHURL string
+	// Hosts statically overrides specific names, answered without ever
+	// reaching an upstream.
+	Hosts map[string]netip.Addr
+	// SplitSuffixes lists domain suffixes that should only ever be
+	// resolved against Upstreams[0] (split-horizon), regardless of
+	// DoHURL - useful for internal zones that a public resolver can't see.
+	SplitSuffixes []string
+}
+
+// dnsResolverAddr is the address SOCKS/TUN clients point their resolver
+// at; it doesn't have to be an address tnet's netstack was explicitly
+// configured to own, since runDNSResolver binds the wildcard address
+// below rather than this specific one.
+const dnsResolverAddr = "100.100.100.100:53"
+
+// runDNSResolver listens for DNS queries inside tnet and answers them
+// through opts, until ctx is done. It binds the wildcard address instead
+// of dnsResolverAddr directly: nothing in this package adds
+// dnsResolverAddr's IP to tnet's configured local addresses, and a gVisor
+// netstack UDP endpoint bound to a specific address it doesn't own fails
+// to bind, so this relies on the wildcard-bind behaviour every netstack
+// supports (accept traffic to any destination IP routed to it) to still
+// answer queries sent to dnsResolverAddr.
+func runDNSResolver(ctx context.Context, l *slog.Logger, tnet *wiresocks.VirtualTun, opts *DNSOptions) error {
+	wildcard := netip.AddrPortFrom(netip.IPv4Unspecified(), 53)
+	pc, err := tnet.ListenUDPAddrPort(wildcard)
+	if err != nil {
+		return fmt.Errorf("listen dns: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	l.Info("serving dns", "address", dnsResolverAddr)
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return nil
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go answerQuery(ctx, l, tnet, pc, from, query, opts)
+	}
+}
+
+func answerQuery(ctx context.Context, l *slog.Logger, tnet *wiresocks.VirtualTun, pc net.PacketConn, from net.Addr, query []byte, opts *DNSOptions) {
+	name, ok := queryName(query)
+	if !ok {
+		return
+	}
+
+	if addr, ok := opts.Hosts[strings.TrimSuffix(name, ".")]; ok {
+		if resp, err := staticAnswer(query, addr); err == nil {
+			_, _ = pc.WriteTo(resp, from)
+			return
+		}
+	}
+
+	upstream, useDoH := pickUpstream(opts, name)
+
+	var resp []byte
+	var err error
+	if useDoH {
+		resp, err = resolveDoH(ctx, tnet, opts.DoHURL, query)
+	} else {
+		resp, err = resolveUDP(ctx, tnet, upstream, query)
+	}
+	if err != nil {
+		l.Error("resolve dns query", "name", name, "error", err)
+		return
+	}
+
+	_, _ = pc.WriteTo(resp, from)
+}
+
+// pickUpstream chooses which upstream answers name: a SplitSuffixes match
+// always goes to Upstreams[0], everything else goes to DoHURL if
+// configured or Upstreams[0] otherwise.
+func pickUpstream(opts *DNSOptions, name string) (addr string, useDoH bool) {
+	name = strings.TrimSuffix(name, ".")
+	for _, suffix := range opts.SplitSuffixes {
+		suffix = strings.TrimSuffix(suffix, ".")
+		// Match on whole labels only: "example.com" must match "example.com"
+		// or "*.example.com", not "notexample.com".
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return firstUpstream(opts), false
+		}
+	}
+	if opts.DoHURL != "" {
+		return "", true
+	}
+	return firstUpstream(opts), false
+}
+
+func firstUpstream(opts *DNSOptions) string {
+	if len(opts.Upstreams) == 0 {
+		return ""
+	}
+	return opts.Upstreams[0]
+}
+
+// resolveUDP forwards query verbatim to addr over a UDP socket dialed
+// through tnet, so resolution itself goes through the WARP tunnel.
+func resolveUDP(ctx context.Context, tnet *wiresocks.VirtualTun, addr string, query []byte) ([]byte, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("no dns upstream configured")
+	}
+
+	raddr, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream %s: %w", addr, err)
+	}
+
+	conn, err := tnet.DialUDPAddrPort(netip.AddrPort{}, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("dial upstream %s: %w", addr, err)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("write query to %s: %w", addr, err)
+	}
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("read response from %s: %w", addr, err)
+	}
+	return buf[:n], nil
+}
+
+// resolveDoH forwards query as a DNS-over-HTTPS POST to dohURL, dialed
+// entirely through tnet so resolution never leaves the WARP tunnel.
+func resolveDoH(ctx context.Context, tnet *wiresocks.VirtualTun, dohURL string, query []byte) ([]byte, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return tnet.DialContext(ctx, network, addr)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dohURL, bytes.NewReader(query))
+	if err != nil {
+		return nil, fmt.Errorf("build doh request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("doh request to %s: %w", dohURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh request to %s: status %s", dohURL, resp.Status)
+	}
+
+	// DoH runs over TCP/HTTPS, not a 1500-byte UDP datagram; cap at a sane
+	// upper bound instead of truncating ordinary EDNS/large-answer replies.
+	const maxDoHResponse = 64 * 1024
+	return io.ReadAll(io.LimitReader(resp.Body, maxDoHResponse))
+}
+
+// queryName extracts the first question's name from a raw DNS message.
+func queryName(query []byte) (string, bool) {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(query); err != nil {
+		return "", false
+	}
+	q, err := parser.Question()
+	if err != nil {
+		return "", false
+	}
+	return q.Name.String(), true
+}
+
+// staticAnswer builds a minimal response for query's first question,
+// answering with addr and preserving the query's transaction ID. It only
+// attaches a record when q.Type matches addr's family (A for an IPv4
+// override, AAAA for an IPv6 one); any other query type gets an empty
+// NOERROR response rather than a record the client didn't ask for and
+// would reject.
+func staticAnswer(query []byte, addr netip.Addr) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:            header.ID,
+		Response:      true,
+		Authoritative: true,
+	})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(q); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case q.Type == dnsmessage.TypeA && addr.Is4():
+		resHeader := dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: 60}
+		if err := builder.AResource(resHeader, dnsmessage.AResource{A: addr.As4()}); err != nil {
+			return nil, err
+		}
+	case q.Type == dnsmessage.TypeAAAA && !addr.Is4():
+		resHeader := dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: 60}
+		if err := builder.AAAAResource(resHeader, dnsmessage.AAAAResource{AAAA: addr.As16()}); err != nil {
+			return nil, err
+		}
+	}
+
+	return builder.Finish()
+}
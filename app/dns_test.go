@@ -0,0 +1,128 @@
+package app
+
+import (
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func buildQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	if err := builder.StartQuestions(); err != nil {
+		t.Fatalf("StartQuestions: %v", err)
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		t.Fatalf("NewName(%q): %v", name, err)
+	}
+	if err := builder.Question(dnsmessage.Question{
+		Name:  n,
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		t.Fatalf("Question: %v", err)
+	}
+	msg, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	return msg
+}
+
+func TestQueryName(t *testing.T) {
+	query := buildQuery(t, "example.com.", dnsmessage.TypeA)
+	name, ok := queryName(query)
+	if !ok {
+		t.Fatal("queryName returned ok=false for a well-formed query")
+	}
+	if name != "example.com." {
+		t.Errorf("queryName = %q, want %q", name, "example.com.")
+	}
+
+	if _, ok := queryName([]byte("not a dns message")); ok {
+		t.Error("queryName should return ok=false for garbage input")
+	}
+}
+
+func TestPickUpstream(t *testing.T) {
+	opts := &DNSOptions{
+		Upstreams:     []string{"1.1.1.1:53"},
+		DoHURL:        "https://1.1.1.1/dns-query",
+		SplitSuffixes: []string{"internal.example.com"},
+	}
+
+	if addr, useDoH := pickUpstream(opts, "public.com"); useDoH == false || addr != "" {
+		t.Errorf("pickUpstream(public.com) = (%q, %v), want DoH", addr, useDoH)
+	}
+
+	if addr, useDoH := pickUpstream(opts, "internal.example.com"); useDoH || addr != "1.1.1.1:53" {
+		t.Errorf("pickUpstream(internal.example.com) = (%q, %v), want split-suffix match to Upstreams[0]", addr, useDoH)
+	}
+
+	if addr, useDoH := pickUpstream(opts, "host.internal.example.com"); useDoH || addr != "1.1.1.1:53" {
+		t.Errorf("pickUpstream(host.internal.example.com) = (%q, %v), want split-suffix match to Upstreams[0]", addr, useDoH)
+	}
+
+	// Must not match on a bare substring across a label boundary, so it
+	// falls through to DoH like any other non-split name.
+	if addr, useDoH := pickUpstream(opts, "notinternal.example.com"); !useDoH || addr != "" {
+		t.Errorf("pickUpstream(notinternal.example.com) = (%q, %v), should not match the internal.example.com split suffix", addr, useDoH)
+	}
+
+	noDoH := &DNSOptions{Upstreams: []string{"9.9.9.9:53"}}
+	if addr, useDoH := pickUpstream(noDoH, "public.com"); useDoH || addr != "9.9.9.9:53" {
+		t.Errorf("pickUpstream with no DoHURL = (%q, %v), want Upstreams[0]", addr, useDoH)
+	}
+}
+
+func TestStaticAnswer(t *testing.T) {
+	v4 := netip.MustParseAddr("10.0.0.5")
+	query := buildQuery(t, "example.com.", dnsmessage.TypeA)
+
+	resp, err := staticAnswer(query, v4)
+	if err != nil {
+		t.Fatalf("staticAnswer: %v", err)
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(resp)
+	if err != nil {
+		t.Fatalf("parsing response: %v", err)
+	}
+	if header.ID != 42 {
+		t.Errorf("response ID = %d, want 42 (preserved from query)", header.ID)
+	}
+	if _, err := parser.AllQuestions(); err != nil {
+		t.Fatalf("AllQuestions: %v", err)
+	}
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		t.Fatalf("AllAnswers: %v", err)
+	}
+	if len(answers) != 1 {
+		t.Fatalf("got %d answers, want 1", len(answers))
+	}
+
+	// An AAAA query against an A-only override gets no record, not a
+	// mismatched one.
+	aaaaQuery := buildQuery(t, "example.com.", dnsmessage.TypeAAAA)
+	resp, err = staticAnswer(aaaaQuery, v4)
+	if err != nil {
+		t.Fatalf("staticAnswer: %v", err)
+	}
+	if _, err := parser.Start(resp); err != nil {
+		t.Fatalf("parsing response: %v", err)
+	}
+	if _, err := parser.AllQuestions(); err != nil {
+		t.Fatalf("AllQuestions: %v", err)
+	}
+	answers, err = parser.AllAnswers()
+	if err != nil {
+		t.Fatalf("AllAnswers: %v", err)
+	}
+	if len(answers) != 0 {
+		t.Errorf("AAAA query against an A override got %d answers, want 0", len(answers))
+	}
+}
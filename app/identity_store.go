@@ -0,0 +1,109 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// IdentityStore loads and persists the wgcf profile behind a named WARP
+// identity, decoupling identity storage from the "./stuff" filesystem
+// layout so warp-plus can be embedded as a library (mobile apps, GUI
+// clients, tests) without requiring a writable disk.
+type IdentityStore interface {
+	Load(name string) (*wiresocks.Config, error)
+	Save(name string, cfg *wiresocks.Config) error
+}
+
+// FileIdentityStore is the default IdentityStore: one directory per
+// identity under root, matching the historical "./stuff/<name>" layout.
+type FileIdentityStore struct {
+	root string
+}
+
+// NewFileIdentityStore returns an IdentityStore rooted at root.
+func NewFileIdentityStore(root string) *FileIdentityStore {
+	return &FileIdentityStore{root: root}
+}
+
+func (s *FileIdentityStore) path(name string) string {
+	return filepath.Join(s.root, name, "wgcf-profile.ini")
+}
+
+func (s *FileIdentityStore) Load(name string) (*wiresocks.Config, error) {
+	return wiresocks.ParseConfig(s.path(name), "")
+}
+
+func (s *FileIdentityStore) Save(name string, cfg *wiresocks.Config) error {
+	dir := filepath.Join(s.root, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create identity dir %s: %w", dir, err)
+	}
+	return cfg.WriteToFile(s.path(name))
+}
+
+// MemoryIdentityStore keeps identities entirely in memory. It is meant for
+// embedding warp-plus as a library where there is no (or no desired)
+// writable filesystem, such as mobile bindings or unit tests.
+type MemoryIdentityStore struct {
+	identities map[string]*wiresocks.Config
+}
+
+// NewMemoryIdentityStore returns an empty in-memory IdentityStore.
+func NewMemoryIdentityStore() *MemoryIdentityStore {
+	return &MemoryIdentityStore{identities: make(map[string]*wiresocks.Config)}
+}
+
+func (s *MemoryIdentityStore) Load(name string) (*wiresocks.Config, error) {
+	cfg, ok := s.identities[name]
+	if !ok {
+		return nil, fmt.Errorf("no identity named %q", name)
+	}
+	return cfg, nil
+}
+
+func (s *MemoryIdentityStore) Save(name string, cfg *wiresocks.Config) error {
+	s.identities[name] = cfg
+	return nil
+}
+
+// loadOrCreateIdentity fetches name from store, registering a brand new
+// WARP identity with Cloudflare and saving it back to store when it isn't
+// found yet.
+func loadOrCreateIdentity(l *slog.Logger, store IdentityStore, name, license string) (*wiresocks.Config, error) {
+	if cfg, err := store.Load(name); err == nil {
+		return cfg, nil
+	}
+
+	cfg, err := warp.CreateIdentity(l, license)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create %s warp identity: %w", name, err)
+	}
+
+	if err := store.Save(name, cfg); err != nil {
+		return nil, fmt.Errorf("couldn't save %s warp identity: %w", name, err)
+	}
+
+	return cfg, nil
+}
+
+// createPrimaryAndSecondaryIdentities loads (or registers) the primary and
+// secondary WARP identities from store and returns their configs directly,
+// rather than leaving callers to re-read them off disk.
+func createPrimaryAndSecondaryIdentities(l *slog.Logger, store IdentityStore, license string) (primary, secondary *wiresocks.Config, err error) {
+	primary, err = loadOrCreateIdentity(l, store, "primary", license)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secondary, err = loadOrCreateIdentity(l, store, "secondary", license)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return primary, secondary, nil
+}
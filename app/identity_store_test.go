@@ -0,0 +1,28 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+func TestMemoryIdentityStore(t *testing.T) {
+	store := NewMemoryIdentityStore()
+
+	if _, err := store.Load("primary"); err == nil {
+		t.Error("Load on an empty store should error")
+	}
+
+	cfg := &wiresocks.Config{}
+	if err := store.Save("primary", cfg); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+
+	got, err := store.Load("primary")
+	if err != nil {
+		t.Fatalf("Load after Save returned error: %v", err)
+	}
+	if got != cfg {
+		t.Error("Load didn't return the identity passed to Save")
+	}
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// inboundPeerKeepaliveSeconds is the persistent_keepalive_interval an
+// active inbound peer runs at, matching the PersistentKeepalive client
+// templates render in GenerateWireGuardInboundKeypair.
+const inboundPeerKeepaliveSeconds = 25
+
+// neverHandshaked stands in for a peer dev has never seen a handshake
+// from, so it always counts as idle regardless of IdleTimeout.
+const neverHandshaked = 365 * 24 * time.Hour
+
+// monitorIdlePeers polls dev's peer handshake times and turns keepalives
+// off for any peer idle longer than idleTimeout, turning them back on once
+// that peer handshakes again. It runs until ctx is done.
+//
+// This never touches a peer's public_key or allowed_ip - dev must keep
+// both to validate that peer's next handshake - so it only removes the
+// keepalive/NAT-probe traffic an idle peer costs, not its ability to
+// reconnect. That's narrower than the idle eviction originally attempted
+// in an earlier version of this feature, which removed the peer from the
+// device entirely and broke exactly that.
+func monitorIdlePeers(ctx context.Context, l *slog.Logger, dev *device.Device, idleTimeout time.Duration) {
+	const pollInterval = 30 * time.Second
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	idled := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ages, err := devicePeerHandshakeAges(dev)
+		if err != nil {
+			l.Warn("poll wireguard inbound peers", "error", err)
+			continue
+		}
+
+		for pub, age := range ages {
+			wantIdle := age > idleTimeout
+			if idled[pub] == wantIdle {
+				continue
+			}
+			keepalive := inboundPeerKeepaliveSeconds
+			if wantIdle {
+				keepalive = 0
+			}
+			if err := setPeerKeepalive(dev, pub, keepalive); err != nil {
+				l.Warn("update idle peer keepalive", "peer", pub, "error", err)
+				continue
+			}
+			idled[pub] = wantIdle
+		}
+	}
+}
+
+// devicePeerHandshakeAges parses dev's uapi config into a map of each
+// peer's public key (hex, as IpcGet renders it) to how long it's been
+// since that peer last handshaked.
+func devicePeerHandshakeAges(dev *device.Device) (map[string]time.Duration, error) {
+	raw, err := dev.IpcGet()
+	if err != nil {
+		return nil, fmt.Errorf("ipc get: %w", err)
+	}
+	return parsePeerHandshakeAges(raw, time.Now()), nil
+}
+
+// parsePeerHandshakeAges does the actual uapi-config parsing behind
+// devicePeerHandshakeAges, split out so it can be unit tested without a
+// real device.Device.
+func parsePeerHandshakeAges(raw string, now time.Time) map[string]time.Duration {
+	ages := make(map[string]time.Duration)
+	var pub string
+	for _, line := range strings.Split(raw, "\n") {
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "public_key":
+			pub = val
+		case "last_handshake_time_sec":
+			if pub == "" {
+				continue
+			}
+			sec, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				continue
+			}
+			if sec == 0 {
+				ages[pub] = neverHandshaked
+				continue
+			}
+			ages[pub] = now.Sub(time.Unix(sec, 0))
+		}
+	}
+	return ages
+}
+
+// setPeerKeepalive reprograms pubHex's persistent_keepalive_interval
+// without touching any of its other fields.
+func setPeerKeepalive(dev *device.Device, pubHex string, seconds int) error {
+	return dev.IpcSet(fmt.Sprintf("public_key=%s\npersistent_keepalive_interval=%d\n", pubHex, seconds))
+}
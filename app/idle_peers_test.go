@@ -0,0 +1,36 @@
+package app
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParsePeerHandshakeAges(t *testing.T) {
+	now := time.Unix(2_000_000_000, 0)
+	raw := "private_key=abc\n" +
+		"listen_port=51820\n" +
+		"public_key=peerA\n" +
+		"last_handshake_time_sec=" + strconv.FormatInt(now.Add(-5*time.Minute).Unix(), 10) + "\n" +
+		"persistent_keepalive_interval=25\n" +
+		"public_key=peerB\n" +
+		"last_handshake_time_sec=0\n"
+
+	ages := parsePeerHandshakeAges(raw, now)
+
+	got, ok := ages["peerA"]
+	if !ok {
+		t.Fatal("peerA missing from parsed ages")
+	}
+	if got != 5*time.Minute {
+		t.Errorf("peerA age = %v, want 5m", got)
+	}
+
+	got, ok = ages["peerB"]
+	if !ok {
+		t.Fatal("peerB missing from parsed ages")
+	}
+	if got != neverHandshaked {
+		t.Errorf("peerB (never handshaked) age = %v, want %v", got, neverHandshaked)
+	}
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"context"
+	"fmt"
+)
+
+// Service is a composable warp subsystem with an explicit lifecycle. Start
+// brings the subsystem up and Close tears it down; splitting the two (as
+// opposed to one function that does both and hopes for the best) is what
+// lets runServices unwind everything that did start when a later service
+// fails, instead of leaking it. This mirrors the Service/PreStarter split
+// sing-box uses for its own subsystems.
+type Service interface {
+	Start(ctx context.Context) error
+	Close() error
+}
+
+// PreStarter is implemented by services that need a validation or setup
+// pass before any service's Start runs - for example parsing a config or
+// resolving endpoints that every later service depends on.
+type PreStarter interface {
+	PreStart() error
+}
+
+// namedService lets a service report a friendly name for error context;
+// services that don't implement it fall back to their Go type name.
+type namedService interface {
+	Name() string
+}
+
+// runServices runs every service's PreStart (where implemented) and then
+// every service's Start, in order. If any step fails, every service that
+// already started is Closed in reverse order before the error is returned,
+// so a failure partway through a chain never leaks the services that came
+// before it.
+func runServices(ctx context.Context, services []Service) error {
+	for _, svc := range services {
+		if p, ok := svc.(PreStarter); ok {
+			if err := p.PreStart(); err != nil {
+				return fmt.Errorf("prestart %s: %w", serviceName(svc), err)
+			}
+		}
+	}
+
+	started := make([]Service, 0, len(services))
+	for _, svc := range services {
+		if err := svc.Start(ctx); err != nil {
+			closeServices(started)
+			return fmt.Errorf("start %s: %w", serviceName(svc), err)
+		}
+		started = append(started, svc)
+	}
+
+	return nil
+}
+
+func closeServices(services []Service) {
+	for i := len(services) - 1; i >= 0; i-- {
+		_ = services[i].Close()
+	}
+}
+
+func serviceName(svc Service) string {
+	if n, ok := svc.(namedService); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", svc)
+}
+
+// funcService adapts a single start/close pair into a Service, for wrapping
+// a self-contained subsystem that doesn't warrant its own Service type.
+type funcService struct {
+	name  string
+	start func(ctx context.Context) error
+	close func() error
+}
+
+func (f *funcService) Name() string                    { return f.name }
+func (f *funcService) Start(ctx context.Context) error { return f.start(ctx) }
+
+func (f *funcService) Close() error {
+	if f.close == nil {
+		return nil
+	}
+	return f.close()
+}
@@ -0,0 +1,229 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+	"golang.org/x/crypto/curve25519"
+)
+
+// WireGuardInboundOptions turns warp-plus into a WireGuard server: clients
+// speak native WireGuard to Bind and their egress traffic is forwarded
+// through the existing WARP tunnel, the same role the WireGuard inbound
+// plays in Xray-core.
+type WireGuardInboundOptions struct {
+	// PrivateKey is the server's base64-encoded WireGuard private key.
+	PrivateKey string
+	// ListenPort is the UDP port client handshakes arrive on.
+	ListenPort uint16
+	// Peers lists the client public keys allowed to connect along with
+	// the tunnel IP each one is assigned. Every peer here is programmed
+	// into the device up front: unlike an outbound tunnel, an inbound
+	// WireGuard server can't defer configuring a peer until traffic is
+	// seen, since it must already hold the peer's public key to accept
+	// that peer's handshake in the first place. IdleTimeout is the
+	// mechanism available for reducing an idle peer's resource use
+	// instead.
+	Peers []WireGuardInboundPeer
+
+	// IdleTimeout, when positive, stops sending keepalives to a peer once
+	// it has gone this long without a handshake, and resumes them once
+	// the peer handshakes again. The peer's key and allowed IP stay
+	// programmed in the device the whole time - they have to, since the
+	// device needs them to validate that peer's next handshake - so this
+	// only trims the keepalive traffic and NAT-traversal probing an idle
+	// peer would otherwise cost, not the peer's ability to reconnect.
+	// Zero disables idle monitoring.
+	IdleTimeout time.Duration
+}
+
+// WireGuardInboundPeer is a single client allowed to dial the inbound
+// WireGuard server.
+type WireGuardInboundPeer struct {
+	PublicKey string
+	TunnelIP  netip.Addr
+}
+
+// validateWireGuardInboundOptions checks that every key in inbound decodes
+// to a valid WireGuard key before runWarpAsWireGuardServer ever touches the
+// device, so a malformed PrivateKey or peer PublicKey comes back as an
+// error from RunWarp instead of panicking deep inside IpcSet.
+func validateWireGuardInboundOptions(inbound *WireGuardInboundOptions) error {
+	if _, err := decodeWireGuardKey(inbound.PrivateKey); err != nil {
+		return fmt.Errorf("invalid wireguard inbound private key: %w", err)
+	}
+	for _, peer := range inbound.Peers {
+		if _, err := decodeWireGuardKey(peer.PublicKey); err != nil {
+			return fmt.Errorf("invalid wireguard inbound peer %s public key: %w", peer.TunnelIP, err)
+		}
+	}
+	return nil
+}
+
+// runWarpAsWireGuardServer runs a user-space WireGuard server, terminates
+// client sessions in a gVisor netstack, and forwards their egress traffic
+// through the WARP tunnel built from endpoint. It listens on
+// inbound.ListenPort across all interfaces, the same as establishWireguard's
+// own tunnels - bind is only the address the forwarded SOCKS/TUN traffic
+// would have used in the other modes and has no meaning here, so callers
+// don't pass one.
+func runWarpAsWireGuardServer(ctx context.Context, l *slog.Logger, endpoint string, inbound *WireGuardInboundOptions, conf *wiresocks.Config) error {
+	// Set up primary/outer warp config exactly like normal warp mode.
+	conf.Interface.MTU = singleMTU
+	for i, peer := range conf.Peers {
+		peer.Endpoint = endpoint
+		peer.Trick = true
+		peer.KeepAlive = 3
+		conf.Peers[i] = peer
+	}
+
+	// Create userspace tun network stack for the outer WARP tunnel.
+	tunDev, tnet, err := newUsermodeTun(conf)
+	if err != nil {
+		return err
+	}
+	logTunOffload(l, tunDev)
+	if err := establishWireguard(l.With("subsystem", "warp"), conf, tunDev, 0); err != nil {
+		return err
+	}
+	defer tunDev.Close()
+	if err := usermodeTunTest(ctx, l, tnet); err != nil {
+		return err
+	}
+
+	// Build the gVisor netstack that terminates inbound client sessions.
+	srvTun, srvTnet, err := netstack.CreateNetTUN(
+		clientTunnelAddrs(inbound.Peers),
+		[]netip.Addr{},
+		singleMTU,
+	)
+	if err != nil {
+		return fmt.Errorf("create wireguard inbound netstack: %w", err)
+	}
+	logTunOffload(l, srvTun)
+
+	srvBind := conn.NewStdNetBind()
+	srvDev := device.NewDevice(srvTun, srvBind, device.NewLogger(device.LogLevelError, "wg-inbound: "))
+
+	// Every peer is programmed up front: a WireGuard responder has to
+	// already hold a peer's public key to validate that peer's handshake,
+	// so there is no "cold" state an inbound server can defer into the
+	// way an outbound tunnel's peer config can.
+	ipc, err := buildInboundDeviceIPC(inbound)
+	if err != nil {
+		return fmt.Errorf("build wireguard inbound config: %w", err)
+	}
+	if err := srvDev.IpcSet(ipc); err != nil {
+		return fmt.Errorf("configure wireguard inbound device: %w", err)
+	}
+	if err := srvDev.Up(); err != nil {
+		return fmt.Errorf("bring up wireguard inbound device: %w", err)
+	}
+	defer srvDev.Close()
+
+	if inbound.IdleTimeout > 0 {
+		go monitorIdlePeers(ctx, l.With("subsystem", "wg-inbound-idle"), srvDev, inbound.IdleTimeout)
+	}
+
+	l.Info("serving wireguard inbound", "listen_port", inbound.ListenPort, "peers", len(inbound.Peers))
+
+	// Forward every client connection accepted on the inbound netstack out
+	// through the WARP tunnel, replacing wiresocks.StartProxy.
+	return wiresocks.ForwardNetTun(ctx, l, srvTnet, tnet)
+}
+
+// buildInboundDeviceIPC renders the full device IPC config that
+// device.Device.IpcSet expects: the server's own key/port plus every peer,
+// programmed eagerly so the device can validate a peer's handshake the
+// first time it arrives.
+func buildInboundDeviceIPC(inbound *WireGuardInboundOptions) (string, error) {
+	privHex, err := decodeWireGuardKey(inbound.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("private key: %w", err)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "private_key=%s\n", privHex)
+	fmt.Fprintf(&b, "listen_port=%d\n", inbound.ListenPort)
+
+	for _, peer := range inbound.Peers {
+		pubHex, err := decodeWireGuardKey(peer.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("peer %s public key: %w", peer.TunnelIP, err)
+		}
+		fmt.Fprintf(&b, "public_key=%s\n", pubHex)
+		fmt.Fprintf(&b, "allowed_ip=%s/32\n", peer.TunnelIP)
+		fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", inboundPeerKeepaliveSeconds)
+	}
+
+	return b.String(), nil
+}
+
+func clientTunnelAddrs(peers []WireGuardInboundPeer) []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(peers))
+	for _, p := range peers {
+		addrs = append(addrs, p.TunnelIP)
+	}
+	return addrs
+}
+
+// decodeWireGuardKey decodes a base64 WireGuard key into the lowercase hex
+// IpcSet expects, returning an error on malformed or wrong-length input
+// instead of panicking, since both the private key and every peer's public
+// key ultimately come from caller-supplied options.
+func decodeWireGuardKey(b64 string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", fmt.Errorf("decode wireguard key: %w", err)
+	}
+	if len(raw) != 32 {
+		return "", fmt.Errorf("wireguard key must decode to 32 bytes, got %d", len(raw))
+	}
+	return fmt.Sprintf("%x", raw), nil
+}
+
+// GenerateWireGuardInboundKeypair creates a fresh client keypair for the
+// WireGuard inbound server and renders a ready-to-paste client config
+// snippet for serverPublicKey/serverEndpoint and the tunnel IP the operator
+// assigns to that client. It is the library half of client provisioning;
+// wiring a "generate client" subcommand to it belongs in cmd/warp-plus,
+// which isn't part of this package.
+func GenerateWireGuardInboundKeypair(serverPublicKey, serverEndpoint string, assignedIP netip.Addr) (privateKey, publicKey, clientConfig string, err error) {
+	var priv [32]byte
+	if _, err := rand.Read(priv[:]); err != nil {
+		return "", "", "", fmt.Errorf("generate private key: %w", err)
+	}
+	priv[0] &= 248
+	priv[31] = (priv[31] & 127) | 64
+
+	pub, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return "", "", "", fmt.Errorf("derive public key: %w", err)
+	}
+
+	privateKey = base64.StdEncoding.EncodeToString(priv[:])
+	publicKey = base64.StdEncoding.EncodeToString(pub)
+
+	clientConfig = fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = %s/32
+
+[Peer]
+PublicKey = %s
+Endpoint = %s
+AllowedIPs = 0.0.0.0/0, ::/0
+PersistentKeepalive = 25
+`, privateKey, assignedIP, serverPublicKey, serverEndpoint)
+
+	return privateKey, publicKey, clientConfig, nil
+}
@@ -0,0 +1,51 @@
+package app
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestDecodeWireGuardKey(t *testing.T) {
+	// 32 zero bytes, base64-encoded.
+	zero := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	hex, err := decodeWireGuardKey(zero)
+	if err != nil {
+		t.Fatalf("decodeWireGuardKey(%q) returned error: %v", zero, err)
+	}
+	if want := strings.Repeat("00", 32); hex != want {
+		t.Errorf("decodeWireGuardKey(%q) = %q, want %q", zero, hex, want)
+	}
+
+	if _, err := decodeWireGuardKey("not-base64!!"); err == nil {
+		t.Error("decodeWireGuardKey with invalid base64 should error")
+	}
+
+	// Valid base64 that decodes to the wrong length.
+	if _, err := decodeWireGuardKey("AAAA"); err == nil {
+		t.Error("decodeWireGuardKey with wrong-length key should error")
+	}
+}
+
+func TestGenerateWireGuardInboundKeypair(t *testing.T) {
+	priv, pub, clientConfig, err := GenerateWireGuardInboundKeypair("serverpubkey=", "203.0.113.1:51820", netip.MustParseAddr("10.0.0.2"))
+	if err != nil {
+		t.Fatalf("GenerateWireGuardInboundKeypair returned error: %v", err)
+	}
+
+	if _, err := decodeWireGuardKey(priv); err != nil {
+		t.Errorf("generated private key doesn't decode: %v", err)
+	}
+	if _, err := decodeWireGuardKey(pub); err != nil {
+		t.Errorf("generated public key doesn't decode: %v", err)
+	}
+	if !strings.Contains(clientConfig, priv) {
+		t.Error("client config doesn't contain the generated private key")
+	}
+	if !strings.Contains(clientConfig, "serverpubkey=") {
+		t.Error("client config doesn't contain the server's public key")
+	}
+	if !strings.Contains(clientConfig, "203.0.113.1:51820") {
+		t.Error("client config doesn't contain the server endpoint")
+	}
+}